@@ -0,0 +1,26 @@
+package main_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var healthCheck string
+
+func TestHealthcheck(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Healthcheck Suite")
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	healthCheck, err = gexec.Build("code.cloudfoundry.org/healthcheck/cmd/healthcheck")
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	gexec.CleanupBuildArtifacts()
+})
@@ -1,10 +1,24 @@
 package main_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -12,6 +26,9 @@ import (
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var _ = Describe("HealthCheck", func() {
@@ -69,7 +86,7 @@ var _ = Describe("HealthCheck", func() {
 				}).Should(HaveOccurred())
 			})
 
-			itExitsWithCode(portHealthCheck, 4, "failure to make TCP request")
+			itExitsWithCode(portHealthCheck, 4, "failure to make TCP connection")
 		})
 	})
 
@@ -119,6 +136,516 @@ var _ = Describe("HealthCheck", func() {
 			})
 		})
 	})
+
+	Describe("https healthcheck", func() {
+		var (
+			ip        string
+			serverCA  *testCA
+			clientCA  *testCA
+			certDir   string
+			tlsServer *ghttp.Server
+		)
+
+		startTLSServer := func(tlsConfig *tls.Config) {
+			tlsServer = ghttp.NewUnstartedServer()
+			listener, err := net.Listen("tcp", ip+":0")
+			Expect(err).NotTo(HaveOccurred())
+
+			tlsServer.HTTPTestServer.Listener = listener
+			tlsServer.HTTPTestServer.TLS = tlsConfig
+			tlsServer.HTTPTestServer.StartTLS()
+			tlsServer.RouteToHandler("GET", "/api/_ping", ghttp.VerifyRequest("GET", "/api/_ping"))
+		}
+
+		httpsHealthCheck := func(extraArgs ...string) func() *gexec.Session {
+			return func() *gexec.Session {
+				u, err := url.Parse(tlsServer.URL())
+				Expect(err).NotTo(HaveOccurred())
+				_, port, err := net.SplitHostPort(u.Host)
+				Expect(err).NotTo(HaveOccurred())
+
+				args := append([]string{
+					"-scheme", "https",
+					"-uri", "/api/_ping",
+					"-port", port,
+					"-timeout", "100ms",
+				}, extraArgs...)
+				session, err := gexec.Start(exec.Command(healthCheck, args...), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				return session
+			}
+		}
+
+		BeforeEach(func() {
+			ip = getNonLoopbackIP()
+			serverCA = newTestCA()
+			clientCA = newTestCA()
+
+			var err error
+			certDir, err = ioutil.TempDir("", "healthcheck-certs")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+			os.RemoveAll(certDir)
+		})
+
+		Context("when the server's certificate is accepted via -insecure-skip-verify", func() {
+			BeforeEach(func() {
+				startTLSServer(serverCA.serverTLSConfig(ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+			})
+
+			itExitsWithCode(httpsHealthCheck("-insecure-skip-verify"), 0, "healthcheck passed")
+		})
+
+		Context("when certificate verification fails", func() {
+			BeforeEach(func() {
+				startTLSServer(serverCA.serverTLSConfig(ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+			})
+
+			itExitsWithCode(httpsHealthCheck(), 7, "failure to complete TLS handshake")
+		})
+
+		Context("when the server's certificate is verified against -ca-cert", func() {
+			BeforeEach(func() {
+				startTLSServer(serverCA.serverTLSConfig(ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+			})
+
+			itExitsWithCode(func() *gexec.Session {
+				return httpsHealthCheck("-ca-cert", serverCA.writeCACert(certDir))()
+			}, 0, "healthcheck passed")
+		})
+
+		Context("when the server's certificate was issued by a different CA than -ca-cert", func() {
+			BeforeEach(func() {
+				startTLSServer(clientCA.serverTLSConfig(ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+			})
+
+			itExitsWithCode(func() *gexec.Session {
+				return httpsHealthCheck("-ca-cert", serverCA.writeCACert(certDir))()
+			}, 7, "failure to complete TLS handshake")
+		})
+
+		Context("when the server's certificate has expired", func() {
+			BeforeEach(func() {
+				startTLSServer(serverCA.serverTLSConfig(ip, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)))
+			})
+
+			itExitsWithCode(func() *gexec.Session {
+				return httpsHealthCheck("-ca-cert", serverCA.writeCACert(certDir))()
+			}, 7, "failure to complete TLS handshake")
+		})
+
+		Context("when the server requires a client certificate", func() {
+			BeforeEach(func() {
+				config := serverCA.serverTLSConfig(ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = clientCA.certPool()
+				startTLSServer(config)
+			})
+
+			Context("when the client presents a certificate signed by the trusted CA", func() {
+				itExitsWithCode(func() *gexec.Session {
+					certFile, keyFile := clientCA.writeLeafCert(certDir, "client", ip, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+					return httpsHealthCheck(
+						"-ca-cert", serverCA.writeCACert(certDir),
+						"-client-cert", certFile,
+						"-client-key", keyFile,
+					)()
+				}, 0, "healthcheck passed")
+			})
+
+			Context("when the client presents no certificate", func() {
+				itExitsWithCode(func() *gexec.Session {
+					return httpsHealthCheck("-ca-cert", serverCA.writeCACert(certDir))()
+				}, 5, "failure to make HTTP request")
+			})
+		})
+	})
+})
+
+var _ = Describe("HealthCheck (http assertions)", func() {
+	var (
+		server     *ghttp.Server
+		serverAddr string
+	)
+
+	assertionHealthCheck := func(extraArgs ...string) func() *gexec.Session {
+		return func() *gexec.Session {
+			_, port, err := net.SplitHostPort(serverAddr)
+			Expect(err).NotTo(HaveOccurred())
+
+			args := append([]string{"-uri", "/api/_ping", "-port", port, "-timeout", "100ms"}, extraArgs...)
+			session, err := gexec.Start(exec.Command(healthCheck, args...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+	}
+
+	itExitsWithCode := func(healthCheck func() *gexec.Session, code int, reason string) {
+		It("exits with code "+strconv.Itoa(code)+" and logs reason", func() {
+			session := healthCheck()
+			Eventually(session).Should(gexec.Exit(code))
+			Expect(session.Out).To(gbytes.Say(reason))
+		})
+	}
+
+	BeforeEach(func() {
+		ip := getNonLoopbackIP()
+		server = ghttp.NewUnstartedServer()
+		listener, err := net.Listen("tcp", ip+":0")
+		Expect(err).NotTo(HaveOccurred())
+
+		server.HTTPTestServer.Listener = listener
+		serverAddr = listener.Addr().String()
+		server.Start()
+	})
+
+	Describe("request headers", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.VerifyHeaderKV("X-Probe", "readiness"))
+		})
+
+		itExitsWithCode(assertionHealthCheck("-request-header", "X-Probe=readiness"), 0, "healthcheck passed")
+	})
+
+	Describe("-expected-status", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(204, ""))
+		})
+
+		Context("when the status is not in the accepted list", func() {
+			itExitsWithCode(assertionHealthCheck(), 6, "failure to get valid HTTP status code")
+		})
+
+		Context("when the status is in the accepted list", func() {
+			itExitsWithCode(assertionHealthCheck("-expected-status", "200,204,301"), 0, "healthcheck passed")
+		})
+	})
+
+	Describe("-expected-body-regex", func() {
+		Context("when the body matches", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(200, "status: ok"))
+			})
+
+			itExitsWithCode(assertionHealthCheck("-expected-body-regex", "^status: ok$"), 0, "healthcheck passed")
+		})
+
+		Context("when the body does not match", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(200, "status: degraded"))
+			})
+
+			itExitsWithCode(assertionHealthCheck("-expected-body-regex", "^status: ok$"), 9, "failure to match expected body")
+		})
+
+		Context("when the body is larger than -max-body-bytes", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(200, "status: ok, padding: "+strings.Repeat("x", 1024)))
+			})
+
+			itExitsWithCode(assertionHealthCheck("-expected-body-regex", "^status: ok", "-max-body-bytes", "16"), 0, "healthcheck passed")
+		})
+	})
+})
+
+var _ = Describe("HealthCheck (readiness/liveness loops)", func() {
+	var (
+		server     *ghttp.Server
+		serverAddr string
+	)
+
+	BeforeEach(func() {
+		ip := getNonLoopbackIP()
+		server = ghttp.NewUnstartedServer()
+		listener, err := net.Listen("tcp", ip+":0")
+		Expect(err).NotTo(HaveOccurred())
+
+		server.HTTPTestServer.Listener = listener
+		serverAddr = listener.Addr().String()
+		server.Start()
+	})
+
+	Describe("readiness mode", func() {
+		It("exits 143 when interrupted while the target is still failing", func() {
+			server.Close()
+			Eventually(func() error {
+				_, err := net.Dial("tcp", serverAddr)
+				return err
+			}).Should(HaveOccurred())
+
+			_, port, err := net.SplitHostPort(serverAddr)
+			Expect(err).NotTo(HaveOccurred())
+
+			session, err := gexec.Start(exec.Command(healthCheck,
+				"-port", port,
+				"-timeout", "100ms",
+				"-readiness-interval", "100ms",
+			), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			session.Command.Process.Signal(syscall.SIGTERM)
+			Eventually(session).Should(gexec.Exit(143))
+		})
+	})
+
+	Describe("liveness mode", func() {
+		It("does not exit while consecutive failures stay below the threshold", func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(500, ""))
+
+			_, port, err := net.SplitHostPort(serverAddr)
+			Expect(err).NotTo(HaveOccurred())
+
+			session, err := gexec.Start(exec.Command(healthCheck,
+				"-uri", "/api/_ping",
+				"-port", port,
+				"-timeout", "100ms",
+				"-liveness-interval", "50ms",
+				"-liveness-failure-threshold", "3",
+			), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Consistently(session, "70ms").ShouldNot(gexec.Exit())
+			session.Command.Process.Signal(syscall.SIGTERM)
+			Eventually(session).Should(gexec.Exit(143))
+		})
+	})
+})
+
+var _ = Describe("HealthCheck (unix socket)", func() {
+	var (
+		server     *httptest.Server
+		socketPath string
+	)
+
+	unixHealthCheck := func() *gexec.Session {
+		session, err := gexec.Start(exec.Command(healthCheck,
+			"-network", "unix",
+			"-socket", socketPath,
+			"-uri", "/api/_ping",
+			"-timeout", "100ms",
+		), GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "healthcheck-unix")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(dir, "healthcheck.sock")
+
+		listener, err := net.Listen("unix", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/_ping" {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		server.Listener = listener
+		server.Start()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(filepath.Dir(socketPath))
+	})
+
+	Context("when the socket is listening", func() {
+		It("exits with code 0 and logs reason", func() {
+			session := unixHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("healthcheck passed"))
+		})
+	})
+
+	Context("when the socket is not listening", func() {
+		BeforeEach(func() {
+			server.Close()
+		})
+
+		It("exits with code 5 and logs reason", func() {
+			session := unixHealthCheck()
+			Eventually(session).Should(gexec.Exit(5))
+			Expect(session.Out).To(gbytes.Say("failure to make HTTP request"))
+		})
+	})
+})
+
+var _ = Describe("HealthCheck (gRPC)", func() {
+	var (
+		ip         string
+		listener   net.Listener
+		grpcServer *grpc.Server
+		healthSrv  *health.Server
+	)
+
+	grpcHealthCheck := func(extraArgs ...string) func() *gexec.Session {
+		return func() *gexec.Session {
+			_, port, err := net.SplitHostPort(listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+
+			args := append([]string{"-protocol", "grpc", "-port", port, "-timeout", "100ms"}, extraArgs...)
+			session, err := gexec.Start(exec.Command(healthCheck, args...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+	}
+
+	BeforeEach(func() {
+		ip = getNonLoopbackIP()
+
+		var err error
+		listener, err = net.Listen("tcp", ip+":0")
+		Expect(err).NotTo(HaveOccurred())
+
+		healthSrv = health.NewServer()
+		grpcServer = grpc.NewServer()
+		grpc_health_v1.RegisterHealthServer(grpcServer, healthSrv)
+		go grpcServer.Serve(listener)
+	})
+
+	AfterEach(func() {
+		grpcServer.Stop()
+	})
+
+	Context("when the service reports SERVING", func() {
+		BeforeEach(func() {
+			healthSrv.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+		})
+
+		itExitsWithCode := func(healthCheck func() *gexec.Session, code int, reason string) {
+			It("exits with code "+strconv.Itoa(code)+" and logs reason", func() {
+				session := healthCheck()
+				Eventually(session).Should(gexec.Exit(code))
+				Expect(session.Out).To(gbytes.Say(reason))
+			})
+		}
+
+		itExitsWithCode(grpcHealthCheck(), 0, "healthcheck passed")
+	})
+
+	Context("when the service reports NOT_SERVING", func() {
+		BeforeEach(func() {
+			healthSrv.SetServingStatus("payments", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		})
+
+		It("exits with code 6 and logs reason", func() {
+			session := grpcHealthCheck("-grpc-service", "payments")()
+			Eventually(session).Should(gexec.Exit(6))
+			Expect(session.Out).To(gbytes.Say("gRPC health check reported NOT_SERVING"))
+		})
+	})
+
+	Context("when the queried service is unknown", func() {
+		It("exits with code 5 and logs reason", func() {
+			session := grpcHealthCheck("-grpc-service", "nonexistent")()
+			Eventually(session).Should(gexec.Exit(5))
+			Expect(session.Out).To(gbytes.Say("failure to make gRPC request"))
+		})
+	})
+
+	Context("when the target is not listening", func() {
+		BeforeEach(func() {
+			grpcServer.Stop()
+		})
+
+		It("exits with code 65 and logs reason", func() {
+			session := grpcHealthCheck()()
+			Eventually(session).Should(gexec.Exit(65))
+			Expect(session.Out).To(gbytes.Say("timeout when dialing gRPC target"))
+		})
+	})
+})
+
+var _ = Describe("HealthCheck (IPv6)", func() {
+	var (
+		server     *ghttp.Server
+		serverAddr string
+	)
+
+	ipv6HealthCheck := func(extraArgs ...string) func() *gexec.Session {
+		return func() *gexec.Session {
+			_, port, err := net.SplitHostPort(serverAddr)
+			Expect(err).NotTo(HaveOccurred())
+
+			args := append([]string{"-address-family", "ipv6", "-port", port, "-timeout", "100ms"}, extraArgs...)
+			session, err := gexec.Start(exec.Command(healthCheck, args...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+	}
+
+	itExitsWithCode := func(healthCheck func() *gexec.Session, code int, reason string) {
+		It("exits with code "+strconv.Itoa(code)+" and logs reason", func() {
+			session := healthCheck()
+			Eventually(session).Should(gexec.Exit(code))
+			Expect(session.Out).To(gbytes.Say(reason))
+		})
+	}
+
+	ip, ok := getNonLoopbackIPv6()
+	if !ok {
+		return
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewUnstartedServer()
+		listener, err := net.Listen("tcp", "["+ip+"]:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		server.HTTPTestServer.Listener = listener
+		serverAddr = listener.Addr().String()
+		server.Start()
+	})
+
+	Describe("port healthcheck", func() {
+		Context("when the address is listening", func() {
+			itExitsWithCode(ipv6HealthCheck(), 0, "healthcheck passed")
+		})
+
+		Context("when the address is not listening", func() {
+			BeforeEach(func() {
+				server.Close()
+				Eventually(func() error {
+					_, err := net.Dial("tcp", serverAddr)
+					return err
+				}).Should(HaveOccurred())
+			})
+
+			itExitsWithCode(ipv6HealthCheck(), 4, "failure to make TCP connection")
+		})
+	})
+
+	Describe("http healthcheck", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.VerifyRequest("GET", "/api/_ping"))
+		})
+
+		Context("when the address is listening", func() {
+			itExitsWithCode(ipv6HealthCheck("-uri", "/api/_ping"), 0, "healthcheck passed")
+		})
+
+		Context("when the address returns error http code", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(500, ""))
+			})
+
+			itExitsWithCode(ipv6HealthCheck("-uri", "/api/_ping"), 6, "failure to get valid HTTP status code")
+		})
+
+		Context("when the address is not listening", func() {
+			BeforeEach(func() {
+				server.Close()
+			})
+
+			itExitsWithCode(ipv6HealthCheck("-uri", "/api/_ping"), 5, "failure to make HTTP request")
+		})
+	})
 })
 
 func getNonLoopbackIP() string {
@@ -141,3 +668,124 @@ func getNonLoopbackIP() string {
 	Fail("no non-loopback address found")
 	panic("non-reachable")
 }
+
+// getNonLoopbackIPv6 returns a non-loopback IPv6 address to bind test servers
+// to, and false if the host has none (IPv6 test environments are not always
+// available, e.g. in CI).
+func getNonLoopbackIPv6() (string, bool) {
+	interfaces, err := net.Interfaces()
+	Expect(err).NotTo(HaveOccurred())
+	for _, intf := range interfaces {
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() == nil {
+				return ipnet.IP.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// testCA is a minimal self-signed certificate authority used to issue
+// server and client leaf certificates for the https healthcheck tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "healthcheck test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issueLeafCert signs a PEM encoded certificate and key for commonName,
+// valid for ip, from notBefore to notAfter.
+func (ca *testCA) issueLeafCert(commonName, ip string, notBefore, notAfter time.Time) (certPEM, keyPEM []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM
+}
+
+// serverTLSConfig returns a tls.Config presenting a leaf certificate for ip
+// issued by ca, valid from notBefore to notAfter.
+func (ca *testCA) serverTLSConfig(ip string, notBefore, notAfter time.Time) *tls.Config {
+	certPEM, keyPEM := ca.issueLeafCert(ip, ip, notBefore, notAfter)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	Expect(err).NotTo(HaveOccurred())
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func (ca *testCA) certPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeCACert writes the CA's certificate to dir and returns its path.
+func (ca *testCA) writeCACert(dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	Expect(ioutil.WriteFile(path, pemEncodeCert(ca.cert), 0600)).To(Succeed())
+	return path
+}
+
+// writeLeafCert issues a leaf certificate for ip, writes its certificate and
+// key to dir under name, and returns their paths.
+func (ca *testCA) writeLeafCert(dir, name, ip string, notBefore, notAfter time.Time) (certFile, keyFile string) {
+	certPEM, keyPEM := ca.issueLeafCert(name, ip, notBefore, notAfter)
+
+	certFile = filepath.Join(dir, name+".pem")
+	Expect(ioutil.WriteFile(certFile, certPEM, 0600)).To(Succeed())
+
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+func pemEncodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func randomSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	Expect(err).NotTo(HaveOccurred())
+	return n
+}
@@ -1,24 +1,63 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/healthcheck"
 )
 
 var (
-	network           string
-	uri               string
-	port              string
-	timeout           time.Duration
-	readinessInterval time.Duration
-	livenessInterval  time.Duration
+	network                  string
+	uri                      string
+	port                     string
+	timeout                  time.Duration
+	readinessInterval        time.Duration
+	livenessInterval         time.Duration
+	addressFamily            string
+	scheme                   string
+	caCert                   string
+	clientCert               string
+	clientKey                string
+	serverName               string
+	insecureSkipVerify       bool
+	socket                   string
+	protocol                 string
+	grpcService              string
+	grpc                     bool
+	expectedStatus           string
+	expectedBodyRegex        string
+	maxBodyBytes             int64
+	requestHeaders           headerFlag
+	readinessBackoffMax      time.Duration
+	livenessFailureThreshold int
 )
 
+// headerFlag collects repeated -request-header key=value flags.
+type headerFlag []string
+
+func (h *headerFlag) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *headerFlag) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
 func init() {
 	flag.StringVar(
 		&network,
@@ -56,31 +95,312 @@ func init() {
 		-1,
 		"if set, starts the healthcheck in liveness mode, i.e. do not exit until the healthcheck fail. runs checks every liveness-interval",
 	)
+	flag.StringVar(
+		&addressFamily,
+		"address-family",
+		"ipv4",
+		"address family to healthcheck with (ipv4, ipv6, dual)",
+	)
+	flag.StringVar(
+		&scheme,
+		"scheme",
+		"http",
+		"scheme to use for the HTTP healthcheck (http, https)",
+	)
+	flag.StringVar(
+		&caCert,
+		"ca-cert",
+		"",
+		"path to a PEM encoded CA certificate used to verify the server's certificate (https only)",
+	)
+	flag.StringVar(
+		&clientCert,
+		"client-cert",
+		"",
+		"path to a PEM encoded client certificate to present to the server (https only, requires -client-key)",
+	)
+	flag.StringVar(
+		&clientKey,
+		"client-key",
+		"",
+		"path to the PEM encoded private key for -client-cert (https only, requires -client-cert)",
+	)
+	flag.StringVar(
+		&serverName,
+		"server-name",
+		"",
+		"server name used to verify the server's certificate (https only, defaults to the healthcheck host)",
+	)
+	flag.BoolVar(
+		&insecureSkipVerify,
+		"insecure-skip-verify",
+		false,
+		"skip verification of the server's certificate chain and host name (https only, insecure)",
+	)
+	flag.StringVar(
+		&socket,
+		"socket",
+		"",
+		"path to the unix socket to healthcheck (network=unix only, defaults to -port)",
+	)
+	flag.StringVar(
+		&protocol,
+		"protocol",
+		"",
+		"protocol to healthcheck with (tcp, http, grpc; defaults to tcp or http based on -uri)",
+	)
+	flag.StringVar(
+		&grpcService,
+		"grpc-service",
+		"",
+		"service name to check via the grpc.health.v1 Check RPC (protocol=grpc only)",
+	)
+	flag.BoolVar(
+		&grpc,
+		"grpc",
+		false,
+		"shorthand for -protocol=grpc",
+	)
+	flag.StringVar(
+		&expectedStatus,
+		"expected-status",
+		"",
+		"comma-separated list of HTTP status codes treated as success (defaults to 200)",
+	)
+	flag.StringVar(
+		&expectedBodyRegex,
+		"expected-body-regex",
+		"",
+		"if set, the HTTP response body must match this regex",
+	)
+	flag.Int64Var(
+		&maxBodyBytes,
+		"max-body-bytes",
+		0,
+		"maximum number of response body bytes read for -expected-body-regex matching (defaults to 64KiB)",
+	)
+	flag.Var(
+		&requestHeaders,
+		"request-header",
+		"a \"key=value\" header to send with the HTTP healthcheck request (repeatable)",
+	)
+	flag.DurationVar(
+		&readinessBackoffMax,
+		"readiness-backoff-max",
+		0,
+		"if set, the wait between failed readiness probes doubles on each failure, up to this cap",
+	)
+	flag.IntVar(
+		&livenessFailureThreshold,
+		"liveness-failure-threshold",
+		1,
+		"number of consecutive failed liveness probes required before exiting non-zero",
+	)
+}
+
+func parseExpectedStatus(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var codes []int
+	for _, part := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, errors.New("invalid status code: " + part)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func parseRequestHeaders(headers []string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	h := make(http.Header, len(headers))
+	for _, header := range headers {
+		i := strings.Index(header, "=")
+		if i < 0 {
+			return nil, errors.New("invalid -request-header (expected key=value): " + header)
+		}
+		h.Add(header[:i], header[i+1:])
+	}
+	return h, nil
+}
+
+func buildTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.New("failure to read CA certificate: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("failure to parse CA certificate: " + caCert)
+		}
+		config.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.New("failure to load client certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func newHealthCheck(network, uri, port string, timeout time.Duration) (healthcheck.HealthCheck, error) {
+	family := healthcheck.AddressFamily(addressFamily)
+	switch family {
+	case healthcheck.AddressFamilyIPv4, healthcheck.AddressFamilyIPv6, healthcheck.AddressFamilyDual:
+	default:
+		return healthcheck.HealthCheck{}, errors.New("invalid address family: " + addressFamily)
+	}
+
+	switch scheme {
+	case "http", "https":
+	default:
+		return healthcheck.HealthCheck{}, errors.New("invalid scheme: " + scheme)
+	}
+
+	proto := protocol
+	if grpc {
+		proto = "grpc"
+	}
+	switch proto {
+	case "", "tcp", "http", "grpc":
+	default:
+		return healthcheck.HealthCheck{}, errors.New("invalid protocol: " + proto)
+	}
+
+	var tlsConfig *tls.Config
+	if scheme == "https" {
+		var err error
+		tlsConfig, err = buildTLSConfig()
+		if err != nil {
+			return healthcheck.HealthCheck{}, err
+		}
+	}
+
+	socketPath := socket
+	if network == "unix" && socketPath == "" {
+		socketPath = port
+	}
+
+	statusCodes, err := parseExpectedStatus(expectedStatus)
+	if err != nil {
+		return healthcheck.HealthCheck{}, err
+	}
+
+	var bodyRegex *regexp.Regexp
+	if expectedBodyRegex != "" {
+		bodyRegex, err = regexp.Compile(expectedBodyRegex)
+		if err != nil {
+			return healthcheck.HealthCheck{}, errors.New("invalid -expected-body-regex: " + err.Error())
+		}
+	}
+
+	headers, err := parseRequestHeaders(requestHeaders)
+	if err != nil {
+		return healthcheck.HealthCheck{}, err
+	}
+
+	return healthcheck.NewHealthCheck(healthcheck.Config{
+		Network:           network,
+		URI:               uri,
+		Port:              port,
+		Timeout:           timeout,
+		AddressFamily:     family,
+		Scheme:            scheme,
+		TLSConfig:         tlsConfig,
+		Socket:            socketPath,
+		Protocol:          healthcheck.Protocol(proto),
+		GRPCService:       grpcService,
+		ExpectedStatus:    statusCodes,
+		ExpectedBodyRegex: bodyRegex,
+		MaxBodyBytes:      maxBodyBytes,
+		Headers:           headers,
+	}), nil
+}
+
+// interruptedError is returned when realMain is cancelled by SIGINT/SIGTERM
+// while waiting in a readiness or liveness loop.
+type interruptedError struct {
+	lastErr error
+}
+
+func (e *interruptedError) Error() string {
+	if e.lastErr == nil {
+		return "interrupted"
+	}
+	return "interrupted, last check error: " + e.lastErr.Error()
+}
+
+// sleep waits for d, or returns early if ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func realMain() error {
+func realMain(ctx context.Context) error {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return errors.New("failure to get interfaces: " + err.Error())
 	}
 
-	h := newHealthCheck(network, uri, port, timeout)
+	h, err := newHealthCheck(network, uri, port, timeout)
+	if err != nil {
+		return err
+	}
 
 	if readinessInterval > 0 {
+		wait := readinessInterval
 		for {
-			if err := h.CheckInterfaces(interfaces); err == nil {
+			lastErr := h.CheckInterfaces(interfaces)
+			if lastErr == nil {
 				return nil
 			}
-			time.Sleep(readinessInterval)
+			if err := sleep(ctx, wait); err != nil {
+				return &interruptedError{lastErr: lastErr}
+			}
+			if readinessBackoffMax > 0 {
+				wait *= 2
+				if wait > readinessBackoffMax {
+					wait = readinessBackoffMax
+				}
+			}
 		}
 	}
 
 	if livenessInterval > 0 {
+		failures := 0
 		for {
-			if err := h.CheckInterfaces(interfaces); err != nil {
-				return err
+			lastErr := h.CheckInterfaces(interfaces)
+			if lastErr != nil {
+				failures++
+				if failures >= livenessFailureThreshold {
+					return lastErr
+				}
+			} else {
+				failures = 0
+			}
+			if err := sleep(ctx, livenessInterval); err != nil {
+				return &interruptedError{lastErr: lastErr}
 			}
-			time.Sleep(livenessInterval)
 		}
 	}
 
@@ -90,11 +410,27 @@ func realMain() error {
 func main() {
 	flag.Parse()
 
-	if err := realMain(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	err := realMain(ctx)
+	signal.Stop(sigCh)
+	cancel()
+
+	if err != nil {
 		if e, ok := err.(*healthcheck.HealthCheckError); ok {
 			os.Stdout.WriteString("healthcheck failed: " + e.Message)
 			os.Exit(e.Code)
 		}
+		if e, ok := err.(*interruptedError); ok {
+			os.Stdout.WriteString("healthcheck failed: " + e.Error())
+			os.Exit(143)
+		}
 		os.Stdout.WriteString("healthcheck failed(unknown error)" + err.Error())
 		os.Exit(127)
 	}
@@ -1,15 +1,31 @@
 package healthcheck
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
-	"strings"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
+// defaultMaxBodyBytes bounds how much of an HTTP response body is read
+// into memory to match against ExpectedBodyRegex, when Config.MaxBodyBytes
+// is unset.
+const defaultMaxBodyBytes = 64 * 1024
+
 type HealthCheckError struct {
 	Code    int
 	Message string
@@ -19,28 +35,153 @@ func (e *HealthCheckError) Error() string {
 	return e.Message
 }
 
+// AddressFamily selects which interface addresses CheckInterfaces will
+// consider when looking for a suitable address to check.
+type AddressFamily string
+
+const (
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+	AddressFamilyDual AddressFamily = "dual"
+)
+
+// Protocol selects which healthcheck is performed by CheckInterfaces. The
+// zero value, ProtocolAuto, preserves the historical behavior of picking
+// PortHealthCheck or HTTPHealthCheck based on whether a URI was given.
+type Protocol string
+
+const (
+	ProtocolAuto Protocol = ""
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolHTTP Protocol = "http"
+	ProtocolGRPC Protocol = "grpc"
+)
+
+// Config holds the parameters used to construct a HealthCheck. It is a
+// struct, rather than a long list of constructor arguments, because the
+// set of supported checks (TCP, HTTP, HTTPS, ...) keeps growing.
+type Config struct {
+	Network       string
+	URI           string
+	Port          string
+	Timeout       time.Duration
+	AddressFamily AddressFamily
+
+	// Scheme is either "http" or "https". If empty, "http" is assumed.
+	Scheme string
+
+	// TLSConfig is used for the HTTP client when Scheme is "https". It is
+	// ignored otherwise.
+	TLSConfig *tls.Config
+
+	// Socket is the path to a unix socket to dial. It is only used when
+	// Network is "unix", in which case interface/port enumeration is
+	// skipped entirely in favor of a single check against the socket.
+	Socket string
+
+	// Protocol selects the check performed against the target. Defaults
+	// to ProtocolAuto.
+	Protocol Protocol
+
+	// GRPCService is the service name passed in the grpc.health.v1 Check
+	// request. Only used when Protocol is ProtocolGRPC. The empty string
+	// checks the overall server health, per the grpc.health.v1 spec.
+	GRPCService string
+
+	// ExpectedStatus lists the HTTP status codes treated as success. If
+	// empty, only http.StatusOK is accepted.
+	ExpectedStatus []int
+
+	// ExpectedBodyRegex, if set, must match the response body for the
+	// HTTP healthcheck to pass.
+	ExpectedBodyRegex *regexp.Regexp
+
+	// MaxBodyBytes caps how much of the response body is read for
+	// ExpectedBodyRegex matching. Defaults to defaultMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// Headers are added to every HTTP healthcheck request.
+	Headers http.Header
+}
+
 type HealthCheck struct {
-	network string
-	uri     string
-	port    string
-	timeout time.Duration
+	network           string
+	uri               string
+	port              string
+	timeout           time.Duration
+	addressFamily     AddressFamily
+	scheme            string
+	tlsConfig         *tls.Config
+	socket            string
+	protocol          Protocol
+	grpcService       string
+	expectedStatus    []int
+	expectedBodyRegex *regexp.Regexp
+	maxBodyBytes      int64
+	headers           http.Header
 }
 
-func NewHealthCheck(network, uri, port string, timeout time.Duration) HealthCheck {
+func NewHealthCheck(config Config) HealthCheck {
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
 	return HealthCheck{
-		network: network,
-		uri:     uri,
-		port:    port,
-		timeout: timeout,
+		network:           config.Network,
+		uri:               config.URI,
+		port:              config.Port,
+		timeout:           config.Timeout,
+		addressFamily:     config.AddressFamily,
+		scheme:            scheme,
+		tlsConfig:         config.TLSConfig,
+		socket:            config.Socket,
+		protocol:          config.Protocol,
+		grpcService:       config.GRPCService,
+		expectedStatus:    config.ExpectedStatus,
+		expectedBodyRegex: config.ExpectedBodyRegex,
+		maxBodyBytes:      config.MaxBodyBytes,
+		headers:           config.Headers,
+	}
+}
+
+func (h *HealthCheck) matchesAddressFamily(ip net.IP) bool {
+	switch h.addressFamily {
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	case AddressFamilyDual:
+		return true
+	default:
+		return ip.To4() != nil
 	}
 }
 
+func (h *HealthCheck) statusIsExpected(code int) bool {
+	if len(h.expectedStatus) == 0 {
+		return code == http.StatusOK
+	}
+	for _, expected := range h.expectedStatus {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *HealthCheck) CheckInterfaces(interfaces []net.Interface) error {
 	healthcheck := h.HTTPHealthCheck
-	if len(h.uri) == 0 {
+	switch {
+	case h.protocol == ProtocolGRPC:
+		healthcheck = h.GRPCHealthCheck
+	case h.protocol == ProtocolTCP || (h.protocol == ProtocolAuto && len(h.uri) == 0):
 		healthcheck = h.PortHealthCheck
 	}
 
+	// A unix socket has no notion of interfaces or addresses, so skip
+	// straight to the check.
+	if h.network == "unix" {
+		return healthcheck(nil)
+	}
+
 	for _, intf := range interfaces {
 		addrs, err := intf.Addrs()
 		if err != nil {
@@ -48,7 +189,7 @@ func (h *HealthCheck) CheckInterfaces(interfaces []net.Interface) error {
 		}
 
 		for _, a := range addrs {
-			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && h.matchesAddressFamily(ipnet.IP) {
 				err := healthcheck(ipnet.IP)
 				return err
 			}
@@ -58,7 +199,11 @@ func (h *HealthCheck) CheckInterfaces(interfaces []net.Interface) error {
 }
 
 func (h *HealthCheck) PortHealthCheck(ip net.IP) error {
-	conn, err := net.DialTimeout(h.network, IPString(ip)+":"+h.port, h.timeout)
+	addr := net.JoinHostPort(IPString(ip), h.port)
+	if h.network == "unix" {
+		addr = h.socket
+	}
+	conn, err := net.DialTimeout(h.network, addr, h.timeout)
 	if err == nil {
 		conn.Close()
 		return nil
@@ -71,6 +216,30 @@ func (h *HealthCheck) PortHealthCheck(ip net.IP) error {
 	return &HealthCheckError{Code: 4, Message: "failure to make TCP connection: " + err.Error()}
 }
 
+// isTLSError reports whether err is a failure of the client to verify the
+// server's certificate (invalid or expired certificate, host name mismatch,
+// unknown authority) or a reply that is not a TLS record. An alert sent by
+// the server, such as one rejecting the client certificate, is not reported
+// as a TLS error.
+func isTLSError(err error) bool {
+	var certErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var recordHeaderErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &certErr):
+		return true
+	case errors.As(err, &hostnameErr):
+		return true
+	case errors.As(err, &authorityErr):
+		return true
+	case errors.As(err, &recordHeaderErr):
+		return true
+	default:
+		return false
+	}
+}
+
 var noopScratch [4096]byte
 
 func noopReadAll(r io.Reader) {
@@ -84,13 +253,18 @@ func noopReadAll(r io.Reader) {
 
 func (h *HealthCheck) HTTPHealthCheck(ip net.IP) error {
 
-	u, err := url.Parse("http://" + IPString(ip) + ":" + h.port + h.uri)
-	if err != nil {
-		// WARN (CEV): Fix code
-		return &HealthCheckError{Code: -1, Message: "failed to parse URL: " + err.Error()}
+	host := "unix"
+	if h.network != "unix" {
+		host = net.JoinHostPort(IPString(ip), h.port)
+	}
+	u := &url.URL{
+		Scheme: h.scheme,
+		Host:   host,
+		Path:   h.uri,
 	}
-	if strings.LastIndex(u.Host, ":") > strings.LastIndex(u.Host, "]") {
-		u.Host = strings.TrimSuffix(u.Host, ":")
+	header := make(http.Header) // NB (CEV): memory here...
+	for k, v := range h.headers {
+		header[k] = v
 	}
 	req := http.Request{
 		Method:     "GET",
@@ -98,7 +272,7 @@ func (h *HealthCheck) HTTPHealthCheck(ip net.IP) error {
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     make(http.Header), // NB (CEV): memory here...
+		Header:     header,
 		Body:       nil,
 		Host:       u.Host,
 	}
@@ -106,23 +280,58 @@ func (h *HealthCheck) HTTPHealthCheck(ip net.IP) error {
 	client := http.Client{
 		Timeout: h.timeout,
 	}
+	switch {
+	case h.network == "unix":
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, "unix", h.socket)
+			},
+			TLSClientConfig: h.tlsConfig,
+		}
+	case h.scheme == "https":
+		client.Transport = &http.Transport{TLSClientConfig: h.tlsConfig}
+	}
 	resp, err := client.Do(&req)
 
 	if err == nil {
+		if !h.statusIsExpected(resp.StatusCode) {
+			// We need to read the request body to prevent extraneous errors in the server.
+			// We could make a HEAD request but there are concerns about servers that may
+			// not implement the RFC correctly.
+			//
+			noopReadAll(resp.Body)
+			resp.Body.Close()
+
+			return &HealthCheckError{Code: 6,
+				Message: "failure to get valid HTTP status code: " + strconv.Itoa(resp.StatusCode)}
+		}
 
-		// We need to read the request body to prevent extraneous errors in the server.
-		// We could make a HEAD request but there are concerns about servers that may
-		// not implement the RFC correctly.
-		//
-		noopReadAll(resp.Body)
+		if h.expectedBodyRegex == nil {
+			noopReadAll(resp.Body)
+			resp.Body.Close()
+			return nil
+		}
+
+		maxBodyBytes := h.maxBodyBytes
+		if maxBodyBytes <= 0 {
+			maxBodyBytes = defaultMaxBodyBytes
+		}
+		body, rerr := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+		noopReadAll(resp.Body) // drain any remainder so the connection can be reused
 		resp.Body.Close()
+		if rerr != nil {
+			return &HealthCheckError{Code: 5, Message: "failure to read HTTP response body: " + rerr.Error()}
+		}
 
-		if resp.StatusCode == http.StatusOK {
-			return nil
+		if !h.expectedBodyRegex.Match(body) {
+			return &HealthCheckError{Code: 9, Message: "failure to match expected body"}
 		}
+		return nil
+	}
 
-		return &HealthCheckError{Code: 6,
-			Message: "failure to get valid HTTP status code: " + strconv.Itoa(resp.StatusCode)}
+	if isTLSError(err) {
+		return &HealthCheckError{Code: 7, Message: "failure to complete TLS handshake: " + err.Error()}
 	}
 
 	if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -132,6 +341,53 @@ func (h *HealthCheck) HTTPHealthCheck(ip net.IP) error {
 	return &HealthCheckError{Code: 5, Message: "failure to make HTTP request: " + err.Error()}
 }
 
+// GRPCHealthCheck implements the standard grpc.health.v1 protocol: it dials
+// ip:port and issues a Check RPC for h.grpcService, mapping the returned
+// ServingStatus to a HealthCheckError.
+func (h *HealthCheck) GRPCHealthCheck(ip net.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var creds grpc.DialOption
+	if h.scheme == "https" {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(h.tlsConfig))
+	} else {
+		creds = grpc.WithInsecure()
+	}
+
+	target := net.JoinHostPort(IPString(ip), h.port)
+	if h.network == "unix" {
+		target = "unix:" + h.socket
+	}
+	conn, err := grpc.DialContext(ctx, target, creds, grpc.WithBlock())
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return &HealthCheckError{Code: 65, Message: "timeout when dialing gRPC target: " + err.Error()}
+		}
+		return &HealthCheckError{Code: 5, Message: "failure to dial gRPC target: " + err.Error()}
+	}
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: h.grpcService,
+	})
+	if err != nil {
+		if status.Code(err) == codes.DeadlineExceeded {
+			return &HealthCheckError{Code: 65, Message: "timeout when making gRPC request: " + err.Error()}
+		}
+		return &HealthCheckError{Code: 5, Message: "failure to make gRPC request: " + err.Error()}
+	}
+
+	switch resp.Status {
+	case grpc_health_v1.HealthCheckResponse_SERVING:
+		return nil
+	case grpc_health_v1.HealthCheckResponse_NOT_SERVING:
+		return &HealthCheckError{Code: 6, Message: "gRPC health check reported NOT_SERVING"}
+	default:
+		return &HealthCheckError{Code: 8, Message: "gRPC health check reported " + resp.Status.String()}
+	}
+}
+
 // The below are a bit aggressive, but at least in the IPv4 case
 // save you 2 allocs (3 vs. 2).
 